@@ -2,9 +2,11 @@ package image // import "github.com/docker/docker/api/server/router/image"
 
 import (
 	"context"
+	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
-	"net"
+	"fmt"
+	"io"
 	"net/http"
 	"strconv"
 	"strings"
@@ -13,6 +15,7 @@ import (
 	"github.com/docker/distribution/reference"
 	"github.com/docker/docker/api/server/httputils"
 	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/api/types/versions"
 	"github.com/docker/docker/errdefs"
@@ -20,72 +23,13 @@ import (
 	"github.com/docker/docker/pkg/streamformatter"
 	"github.com/docker/docker/pkg/system"
 	"github.com/docker/docker/registry"
+	"github.com/docker/docker/registry/rewriter"
+	digest "github.com/opencontainers/go-digest"
 	specs "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
 
-var (
-	unixSock = "/tmp/server.sock"
-	unixAddr = &net.UnixAddr{
-		Name: unixSock,
-		Net: "unix",
-	}
-	defaultRegistryUrl = "docker.io"
-	defaultUserName = "library"
-)
-
-func getRegistryUrl(imageIdWithTags string) string {
-	dialContext := func(_ context.Context, _, _ string) (net.Conn, error) {
-		return net.DialUnix("unix", nil, unixAddr)
-	}
-	client := &http.Client{
-		Transport: &http.Transport{
-			DialContext: dialContext,
-		},
-	}
-	url := "http://dockerd" + "/" + imageIdWithTags
-	if resp, err := client.Get(url); err != nil {
-		logrus.Error(err)
-	} else {
-		defer resp.Body.Close()
-		if resp.StatusCode == 200 {
-			buf := make([]byte, 32)
-			n, _ := resp.Body.Read(buf)
-			return string(buf[:n])
-		} else {
-			logrus.Errorf("Get registry url: status code is %v", resp.StatusCode)
-		}
-	}
-	return defaultRegistryUrl
-}
-
-func convertImageTag(domain, imageWithoutTag string) string {
-	// the complete format of image tag: domain/user/image:version
-	switch strings.Count(imageWithoutTag, "/") {
-	case 2:
-		// 1. domain/user/image:version
-		i := strings.IndexRune(imageWithoutTag, '/')
-		return domain + "/" + imageWithoutTag[i+1:]
-	case 1:
-		i := strings.IndexRune(imageWithoutTag, '/')
-			if !strings.ContainsAny(imageWithoutTag[:i], ".:") && imageWithoutTag[:i] != "localhost" {
-				// 2. user/image:version
-				return domain + "/" + imageWithoutTag
-		} else {
-			// 3. domain/image:version
-			return domain + "/" + defaultUserName + "/" + imageWithoutTag[i+1:]
-		}
-	case 0:
-		// 4. image:version
-		return domain + "/" + defaultUserName + "/" + imageWithoutTag
-	default:
-		// unreachable
-		// <none>:<none> images have been prefiltered
-		return ""
-	}
-}
-
 // Creates an image from Pull or from Import
 func (s *imageRouter) postImagesCreate(ctx context.Context, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
 
@@ -143,32 +87,49 @@ func (s *imageRouter) postImagesCreate(ctx context.Context, w http.ResponseWrite
 			}
 		}
 
-		// 1. get new registry url; and retag the image
-		registryUrl := getRegistryUrl(image + ":" + tag)
-		newImage := convertImageTag(registryUrl, image)
-
-		// 2. pull image with the new image and tag
-		err = s.backend.PullImage(ctx, newImage, tag, platform, metaHeaders, authConfig, output)
+		// The "tag" form value is overloaded: the client sends a digest
+		// string there for a pull-by-digest, so the two have to be told
+		// apart before the combined reference can be parsed. Routing both
+		// forms through reference.ParseAnyReference, rather than string-
+		// counting slashes, collapses them onto a single canonical path.
+		rawRef := image
+		if tag != "" {
+			if _, dgstErr := digest.Parse(tag); dgstErr == nil {
+				rawRef = image + "@" + tag
+			} else {
+				rawRef = image + ":" + tag
+			}
+		}
 
-		// 3. retag the local image to the original image tag
-		srcTotalImage := newImage + ":" + tag
-		logrus.Infof("Pull succeeds, begin to retag image %s to %s:%s", srcTotalImage, image, tag)
-		newRetagReturn, retagError := s.backend.TagImage(srcTotalImage, image, tag)
-		logrus.Infof("The return result of the retag is %s\n", newRetagReturn)
-		if retagError != nil {
-			logrus.Error(retagError)
+		anyRef, refErr := reference.ParseAnyReference(rawRef)
+		if refErr != nil {
+			return errdefs.InvalidParameter(refErr)
+		}
+		wantRef, ok := anyRef.(reference.Named)
+		if !ok {
+			return errdefs.InvalidParameter(errors.Errorf("%q is not a named image reference", rawRef))
 		}
-		logrus.Info("Retag images succeeds, begin to remove intermediate image.")
 
-		// 4. delete the new image tag if there are redundant tags.
-		srcTotalImageRef, _ := reference.ParseNormalizedNamed(srcTotalImage)
-		if newRetagReturn != reference.FamiliarString(srcTotalImageRef) {
-			_, removeError := s.backend.ImageDelete(srcTotalImage, false, true)
-			if removeError != nil {
-				logrus.Error(removeError)
+		var expectedDigest digest.Digest
+		if raw := firstNonEmpty(r.Header.Get("X-Expected-Digest"), r.Form.Get("expectedDigest")); raw != "" {
+			if expectedDigest, err = digest.Parse(raw); err != nil {
+				return errdefs.InvalidParameter(errors.Wrap(err, "invalid expected digest"))
 			}
 		}
-		logrus.Info("All succeed.")
+
+		targets, resolveErr := s.resolver.Resolve(ctx, wantRef)
+		if resolveErr != nil {
+			return resolveErr
+		}
+		if len(targets) == 0 {
+			// no mirror rule matched; pull the reference as requested
+			targets = []rewriter.Target{{Ref: wantRef}}
+		}
+
+		err = s.mirrorPull(ctx, targets, wantRef, platform, metaHeaders, authConfig, expectedDigest, output)
+		if err == nil {
+			err = s.reportResolvedDigest(wantRef, output)
+		}
 	} else { // import
 		src := r.Form.Get("fromSrc")
 		// 'err' MUST NOT be defined within this block, we need any error
@@ -190,6 +151,349 @@ func (s *imageRouter) postImagesCreate(ctx context.Context, w http.ResponseWrite
 	return nil
 }
 
+// postCommit creates a new image from a container's current state, as
+// "docker commit" does.
+func (s *imageRouter) postCommit(ctx context.Context, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if err := httputils.ParseForm(r); err != nil {
+		return err
+	}
+
+	cname := r.Form.Get("container")
+	if cname == "" {
+		return errdefs.InvalidParameter(errors.New("missing container name or ID"))
+	}
+
+	pause := httputils.BoolValueOrDefault(r, "pause", true)
+
+	cfg, _, _, err := s.decoder.DecodeConfig(r.Body)
+	if err != nil && err != io.EOF {
+		// if there is no body then ignore the error
+		return err
+	}
+	if cfg == nil {
+		cfg = &container.Config{}
+	}
+
+	repo, tag := s.rewriteCommitTarget(ctx, r.Form.Get("repo"), r.Form.Get("tag"))
+
+	imgID, err := s.backend.CommitImage(cname, CommitConfig{
+		Pause:   pause,
+		Repo:    repo,
+		Tag:     tag,
+		Author:  r.Form.Get("author"),
+		Comment: r.Form.Get("comment"),
+		Changes: r.Form["changes"],
+		Config:  cfg,
+	})
+	if err != nil {
+		return err
+	}
+
+	return httputils.WriteJSON(w, http.StatusCreated, &types.IDResponse{ID: imgID})
+}
+
+// rewriteCommitTarget routes repo:tag through the same mirror resolver used
+// by postImagesCreate, when the router was constructed with
+// rewriteCommitRefs set, so a committed image lands in the same namespace a
+// pull of that reference would have used. It falls back to repo/tag
+// unchanged whenever that isn't possible.
+func (s *imageRouter) rewriteCommitTarget(ctx context.Context, repo, tag string) (string, string) {
+	if !s.rewriteCommitRefs || repo == "" {
+		return repo, tag
+	}
+
+	rawRef := repo
+	if tag != "" {
+		rawRef = repo + ":" + tag
+	}
+	ref, err := reference.ParseNormalizedNamed(rawRef)
+	if err != nil {
+		return repo, tag
+	}
+
+	targets, err := s.resolver.Resolve(ctx, ref)
+	if err != nil || len(targets) == 0 {
+		return repo, tag
+	}
+
+	return splitPullRef(targets[0].Ref)
+}
+
+// mirrorPull attempts to pull wantRef through each candidate mirror target
+// in order, falling through to the next candidate when the backend reports
+// the image could not be found or the mirror is unreachable, and retags a
+// successful pull onto wantRef. Every step that touches a mirror is reported
+// through output as a structured status message, and any tag mirrorPull
+// itself created is rolled back if a later step in the same attempt fails,
+// so a partial failure never leaves the user with an image under a mirror
+// name they never requested or leaks the intermediate tag's storage. When a
+// target isn't actually a rewrite of wantRef (no mirror rule matched) and no
+// digest needs verifying, the mirror framing and retag are skipped entirely
+// so an ordinary pull on an unconfigured daemon sees none of it.
+//
+// If expectedDigest is set, the digest of the freshly pulled image is
+// verified against it before anything is committed under wantRef; a
+// mismatch rolls back the pull instead of leaving a locally tagged image
+// behind, which is what makes the check TOFU-style verification rather than
+// an after-the-fact warning. That holds even when no mirror rule rewrote the
+// reference: pulling wantRef directly would let the backend move it onto
+// the freshly pulled (and not yet verified) content before verifyDigest
+// ever runs, so whenever expectedDigest is set a tag pull is staged under a
+// throwaway name first and only retagged onto wantRef once the digest
+// checks out. A digest-pinned wantRef is pulled by its digest instead,
+// which moves no tag.
+func (s *imageRouter) mirrorPull(ctx context.Context, targets []rewriter.Target, wantRef reference.Named, platform *specs.Platform, metaHeaders map[string][]string, authConfig *types.AuthConfig, expectedDigest digest.Digest, output io.Writer) error {
+	var lastErr error
+	for _, target := range targets {
+		auth := authConfig
+		if target.Auth != nil {
+			auth = target.Auth
+		}
+
+		rewritten := target.Ref.String() != wantRef.String()
+		verifying := expectedDigest != ""
+		staged := rewritten || verifying
+
+		pullRef := target.Ref
+		if !rewritten && verifying {
+			pullRef = stagingRef(wantRef)
+		}
+		pulledName := reference.FamiliarString(pullRef)
+
+		var preexisting bool
+		if staged {
+			_, lookupErr := s.backend.LookupImage(pulledName)
+			preexisting = lookupErr == nil
+		}
+
+		if rewritten {
+			writeStatus(output, "Pulling from mirror", pulledName)
+		}
+
+		mirrorImage, mirrorTag := splitPullRef(pullRef)
+		pullErr := s.backend.PullImage(ctx, mirrorImage, mirrorTag, platform, metaHeaders, auth, output)
+		if pullErr != nil {
+			lastErr = pullErr
+			if !isFallbackError(pullErr) {
+				return pullErr
+			}
+			logrus.WithError(pullErr).Warnf("mirror %s failed, trying next candidate", pulledName)
+			continue
+		}
+
+		if err := s.verifyDigest(pullRef, expectedDigest); err != nil {
+			s.rollbackMirrorTag(pulledName, preexisting, output)
+			return err
+		}
+
+		if !staged {
+			return nil
+		}
+
+		return s.retagAndCleanup(pulledName, pullRef, wantRef, preexisting, output)
+	}
+	return lastErr
+}
+
+// stagingRef returns a synthetic reference used to pull wantRef's content
+// under a throwaway tag, so it can be verified before anything is retagged
+// onto the name the client actually requested. This matters for a
+// digest-pinned re-pull of a reference that isn't being mirrored: pulling
+// wantRef directly would let the backend overwrite an already-trusted tag
+// with unverified content before the digest check ever runs.
+func stagingRef(wantRef reference.Named) reference.Named {
+	var suffix [4]byte
+	_, _ = rand.Read(suffix[:])
+
+	ref, err := reference.WithTag(wantRef, fmt.Sprintf("digest-check-%x", suffix))
+	if err != nil {
+		// reference.WithTag only fails for a tag that doesn't match
+		// reference.TagRegexp, which the generated hex suffix always does.
+		panic(err)
+	}
+	return ref
+}
+
+// isFallbackError reports whether err is the kind of failure that should
+// cause mirrorPull to try the next candidate mirror rather than aborting the
+// pull outright.
+func isFallbackError(err error) bool {
+	return errdefs.IsNotFound(err) || errdefs.IsUnavailable(err) || errdefs.IsSystem(err)
+}
+
+// splitPullRef splits ref into the image and tag form expected by
+// Backend.PullImage.
+func splitPullRef(ref reference.Named) (image string, tag string) {
+	if canonical, ok := ref.(reference.Canonical); ok {
+		return reference.FamiliarName(ref), canonical.Digest().String()
+	}
+	if tagged, ok := ref.(reference.Tagged); ok {
+		return reference.FamiliarName(ref), tagged.Tag()
+	}
+	return reference.FamiliarName(ref), ""
+}
+
+// retagAndCleanup retags the image pulled as mirrorRef (identified by
+// mirrorName) back onto wantRef and removes the intermediate mirror tag
+// once it is no longer needed. If the retag itself fails, it rolls back the
+// mirror tag mirrorPull created rather than leaving it behind, unless that
+// tag already existed before the pull.
+func (s *imageRouter) retagAndCleanup(mirrorName string, mirrorRef, wantRef reference.Named, mirrorPreexisting bool, output io.Writer) error {
+	if _, ok := wantRef.(reference.Canonical); ok {
+		if reference.FamiliarName(mirrorRef) == reference.FamiliarName(wantRef) {
+			// already pulled under the requested repository; digests aren't
+			// tags, so there is nothing left to retag.
+			return nil
+		}
+		// TagImage only produces repo:tag targets, so a digest pull routed
+		// through a rewritten mirror keeps the mirror's repository name
+		// locally rather than being retagged onto wantRef.
+		writeStatus(output, "Warning", "digest pulls cannot be retagged; keeping the mirror repository name "+mirrorName)
+		return nil
+	}
+
+	wantTag := ""
+	if tagged, ok := wantRef.(reference.Tagged); ok {
+		wantTag = tagged.Tag()
+	}
+	wantName := reference.FamiliarName(wantRef)
+
+	writeStatus(output, "Retagging", fmt.Sprintf("%s as %s", mirrorName, reference.FamiliarString(wantRef)))
+	newTag, err := s.backend.TagImage(mirrorName, wantName, wantTag)
+	if err != nil {
+		err = errors.Wrap(err, "retagging pulled image")
+		_, _ = output.Write(streamformatter.FormatError(err))
+		s.rollbackMirrorTag(mirrorName, mirrorPreexisting, output)
+		return err
+	}
+
+	if newTag == mirrorName {
+		// the requested name *is* the mirror name; nothing intermediate to
+		// clean up.
+		return nil
+	}
+
+	if mirrorPreexisting {
+		return nil
+	}
+	writeStatus(output, "Cleaning up intermediate tag", mirrorName)
+	if _, err := s.backend.ImageDelete(mirrorName, false, true); err != nil {
+		err = errors.Wrap(err, "cleaning up intermediate mirror tag")
+		_, _ = output.Write(streamformatter.FormatError(err))
+		return err
+	}
+	return nil
+}
+
+// rollbackMirrorTag removes the intermediate mirror tag mirrorPull created,
+// unless it already existed before the pull, so a failed retag never leaves
+// the user with an image under a name they never requested.
+func (s *imageRouter) rollbackMirrorTag(mirrorName string, mirrorPreexisting bool, output io.Writer) {
+	if mirrorPreexisting {
+		return
+	}
+	writeStatus(output, "Rolling back", mirrorName)
+	if _, err := s.backend.ImageDelete(mirrorName, false, true); err != nil {
+		_, _ = output.Write(streamformatter.FormatError(errors.Wrap(err, "rolling back intermediate mirror tag")))
+	}
+}
+
+// writeStatus streams a {"status":"..."} progress message in the same
+// structured JSON form as the rest of the pull progress stream.
+func writeStatus(output io.Writer, status, detail string) {
+	msg := status
+	if detail != "" {
+		msg = status + ": " + detail
+	}
+	_, _ = output.Write(streamformatter.FormatStatus("", "%s", msg))
+}
+
+// digestMessage is streamed to the client as a progress line once a pull has
+// resolved to a known digest, so clients can pin the reference they just
+// pulled without needing full content trust.
+type digestMessage struct {
+	Digest string `json:"digest"`
+}
+
+// verifyDigest checks the digest of pulledRef against expectedDigest, the
+// value of the X-Expected-Digest header / expectedDigest form value. It is a
+// no-op when expectedDigest is unset. Called from mirrorPull right after a
+// successful pull and before anything is retagged onto wantRef, so a
+// mismatch can be rolled back instead of only being reported after the
+// image is already tagged under the name the client asked for.
+func (s *imageRouter) verifyDigest(pulledRef reference.Named, expectedDigest digest.Digest) error {
+	if expectedDigest == "" {
+		return nil
+	}
+
+	dgst, err := s.resolveLocalDigest(pulledRef)
+	if err != nil || dgst == "" {
+		return errdefs.InvalidParameter(errors.Errorf("could not resolve a digest for %s to verify against expected digest %s", reference.FamiliarString(pulledRef), expectedDigest))
+	}
+
+	if dgst != expectedDigest {
+		return errdefs.InvalidParameter(errors.Errorf("resolved digest %s for %s does not match expected digest %s", dgst, reference.FamiliarString(pulledRef), expectedDigest))
+	}
+	return nil
+}
+
+// reportResolvedDigest resolves the digest of the image now tagged as
+// wantRef and streams it to output as a digestMessage, so clients can pin
+// the reference they just pulled. Any X-Expected-Digest verification has
+// already happened in mirrorPull, before the pull was committed under
+// wantRef, so this is purely informational.
+func (s *imageRouter) reportResolvedDigest(wantRef reference.Named, output io.Writer) error {
+	dgst, err := s.resolveLocalDigest(wantRef)
+	if err != nil || dgst == "" {
+		// best effort only: a mirror or image that doesn't publish a repo
+		// digest simply can't be pinned.
+		return nil
+	}
+
+	msg, err := json.Marshal(digestMessage{Digest: dgst.String()})
+	if err != nil {
+		return err
+	}
+	_, err = output.Write(append(msg, '\n'))
+	return err
+}
+
+// resolveLocalDigest returns the repo digest of the locally tagged image
+// matching ref: the digest itself if ref already pins one, or the matching
+// entry in the backend's recorded RepoDigests otherwise.
+func (s *imageRouter) resolveLocalDigest(ref reference.Named) (digest.Digest, error) {
+	if canonical, ok := ref.(reference.Canonical); ok {
+		return canonical.Digest(), nil
+	}
+
+	inspect, err := s.backend.LookupImage(reference.FamiliarString(ref))
+	if err != nil {
+		return "", err
+	}
+
+	wantName := reference.FamiliarName(ref)
+	for _, repoDigest := range inspect.RepoDigests {
+		ref, err := reference.ParseNormalizedNamed(repoDigest)
+		if err != nil {
+			continue
+		}
+		if canonical, ok := ref.(reference.Canonical); ok && reference.FamiliarName(ref) == wantName {
+			return canonical.Digest(), nil
+		}
+	}
+	return "", nil
+}
+
+// firstNonEmpty returns the first non-empty string among values.
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
 func (s *imageRouter) postImagesPush(ctx context.Context, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
 	metaHeaders := map[string][]string{}
 	for k, v := range r.Header {
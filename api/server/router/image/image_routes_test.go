@@ -0,0 +1,498 @@
+package image // import "github.com/docker/docker/api/server/router/image"
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/registry"
+	"github.com/docker/docker/errdefs"
+	"github.com/docker/docker/registry/rewriter"
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	testDigestA = "sha256:aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	testDigestB = "sha256:bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+)
+
+// commitCall records a single Backend.CommitImage invocation.
+type commitCall struct {
+	container string
+	cfg       CommitConfig
+}
+
+// fakeBackend is a minimal Backend implementation that records the calls
+// mirrorPull and postCommit make and lets individual steps be made to fail.
+type fakeBackend struct {
+	pullErrs     []error
+	pulledDigest string // if set, a successful PullImage "discovers" this digest for the pulled name
+	tagErr       error
+	tagReturn    string
+	deleteErr    error
+	commitErr    error
+	commitID     string
+	lookups      map[string]*types.ImageInspect
+
+	pulled    []string
+	tagged    []string
+	deleted   []string
+	committed []commitCall
+}
+
+func (f *fakeBackend) PullImage(ctx context.Context, img, tag string, platform *specs.Platform, metaHeaders map[string][]string, authConfig *types.AuthConfig, outStream io.Writer) error {
+	key := img
+	if tag != "" {
+		key += ":" + tag
+	}
+	f.pulled = append(f.pulled, key)
+	if len(f.pullErrs) > 0 {
+		err := f.pullErrs[0]
+		f.pullErrs = f.pullErrs[1:]
+		return err
+	}
+	if f.pulledDigest != "" {
+		if _, ok := f.lookups[key]; !ok {
+			f.lookups[key] = &types.ImageInspect{RepoDigests: []string{img + "@" + f.pulledDigest}}
+		}
+	}
+	return nil
+}
+
+func (f *fakeBackend) TagImage(imageName, repository, tag string) (string, error) {
+	f.tagged = append(f.tagged, imageName+"->"+repository+":"+tag)
+	if f.tagErr != nil {
+		return "", f.tagErr
+	}
+	if f.tagReturn != "" {
+		return f.tagReturn, nil
+	}
+	return repository + ":" + tag, nil
+}
+
+func (f *fakeBackend) ImageDelete(imageRef string, force, prune bool) ([]types.ImageDeleteResponseItem, error) {
+	f.deleted = append(f.deleted, imageRef)
+	if f.deleteErr != nil {
+		return nil, f.deleteErr
+	}
+	return nil, nil
+}
+
+func (f *fakeBackend) LookupImage(name string) (*types.ImageInspect, error) {
+	if inspect, ok := f.lookups[name]; ok {
+		return inspect, nil
+	}
+	return nil, errdefs.NotFound(errors.New("no such image"))
+}
+
+func (f *fakeBackend) PushImage(context.Context, string, string, map[string][]string, *types.AuthConfig, io.Writer) error {
+	panic("not implemented")
+}
+
+func (f *fakeBackend) ImportImage(string, string, string, string, string, io.ReadCloser, io.Writer, []string) error {
+	panic("not implemented")
+}
+
+func (f *fakeBackend) ExportImage([]string, io.Writer) error {
+	panic("not implemented")
+}
+
+func (f *fakeBackend) LoadImage(io.ReadCloser, io.Writer, bool) error {
+	panic("not implemented")
+}
+
+func (f *fakeBackend) ImageHistory(string) ([]*image.HistoryResponseItem, error) {
+	panic("not implemented")
+}
+
+func (f *fakeBackend) Images(filters.Args, bool, bool) ([]*types.ImageSummary, error) {
+	panic("not implemented")
+}
+
+func (f *fakeBackend) SearchRegistryForImages(context.Context, string, string, int, *types.AuthConfig, map[string][]string) (*registry.SearchResults, error) {
+	panic("not implemented")
+}
+
+func (f *fakeBackend) ImagesPrune(context.Context, filters.Args) (*types.ImagesPruneReport, error) {
+	panic("not implemented")
+}
+
+func (f *fakeBackend) CommitImage(containerName string, cfg CommitConfig) (string, error) {
+	f.committed = append(f.committed, commitCall{container: containerName, cfg: cfg})
+	if f.commitErr != nil {
+		return "", f.commitErr
+	}
+	if f.commitID != "" {
+		return f.commitID, nil
+	}
+	return "sha256:deadbeef", nil
+}
+
+// fakeResolver is a rewriter.Resolver stub returning a fixed set of targets.
+type fakeResolver struct {
+	targets []rewriter.Target
+	err     error
+}
+
+func (f *fakeResolver) Resolve(ctx context.Context, ref reference.Named) ([]rewriter.Target, error) {
+	return f.targets, f.err
+}
+
+// fakeDecoder is an httputils.ContainerDecoder stub returning a fixed
+// container.Config.
+type fakeDecoder struct {
+	cfg *container.Config
+	err error
+}
+
+func (f *fakeDecoder) DecodeConfig(src io.Reader) (*container.Config, *container.HostConfig, *network.NetworkingConfig, error) {
+	if f.err != nil {
+		return nil, nil, nil, f.err
+	}
+	return f.cfg, nil, nil, nil
+}
+
+func (f *fakeDecoder) DecodeHostConfig(src io.Reader) (*container.HostConfig, error) {
+	return nil, nil
+}
+
+func mustParseNamed(t *testing.T, s string) reference.Named {
+	t.Helper()
+	ref, err := reference.ParseNormalizedNamed(s)
+	if err != nil {
+		t.Fatalf("parsing %q: %v", s, err)
+	}
+	return ref
+}
+
+func TestMirrorPullRetagsOntoRequestedName(t *testing.T) {
+	backend := &fakeBackend{lookups: map[string]*types.ImageInspect{}}
+	r := &imageRouter{backend: backend}
+
+	wantRef := mustParseNamed(t, "ubuntu:latest")
+	mirrorRef := mustParseNamed(t, "mirror.example.com/library/ubuntu:latest")
+	targets := []rewriter.Target{{Ref: mirrorRef}}
+
+	var out bytes.Buffer
+	if err := r.mirrorPull(context.Background(), targets, wantRef, nil, nil, &types.AuthConfig{}, "", &out); err != nil {
+		t.Fatalf("mirrorPull: %v", err)
+	}
+	if len(backend.tagged) != 1 {
+		t.Fatalf("expected one retag call, got %v", backend.tagged)
+	}
+	if len(backend.deleted) != 1 || backend.deleted[0] != "mirror.example.com/library/ubuntu:latest" {
+		t.Fatalf("expected the intermediate mirror tag to be cleaned up, got %v", backend.deleted)
+	}
+}
+
+func TestMirrorPullRollsBackMirrorTagOnRetagFailure(t *testing.T) {
+	backend := &fakeBackend{tagErr: errors.New("boom"), lookups: map[string]*types.ImageInspect{}}
+	r := &imageRouter{backend: backend}
+
+	wantRef := mustParseNamed(t, "ubuntu:latest")
+	mirrorRef := mustParseNamed(t, "mirror.example.com/library/ubuntu:latest")
+	targets := []rewriter.Target{{Ref: mirrorRef}}
+
+	var out bytes.Buffer
+	if err := r.mirrorPull(context.Background(), targets, wantRef, nil, nil, &types.AuthConfig{}, "", &out); err == nil {
+		t.Fatal("expected mirrorPull to return the retag error")
+	}
+	if len(backend.deleted) != 1 || backend.deleted[0] != "mirror.example.com/library/ubuntu:latest" {
+		t.Fatalf("expected rollback to remove the mirror tag it created, got %v", backend.deleted)
+	}
+	if !bytes.Contains(out.Bytes(), []byte("errorDetail")) {
+		t.Fatalf("expected the retag error to be streamed to the client, got %q", out.String())
+	}
+}
+
+func TestMirrorPullDoesNotRemovePreexistingMirrorTagOnFailure(t *testing.T) {
+	mirrorName := "mirror.example.com/library/ubuntu:latest"
+	backend := &fakeBackend{
+		tagErr:  errors.New("boom"),
+		lookups: map[string]*types.ImageInspect{mirrorName: {}},
+	}
+	r := &imageRouter{backend: backend}
+
+	wantRef := mustParseNamed(t, "ubuntu:latest")
+	mirrorRef := mustParseNamed(t, mirrorName)
+	targets := []rewriter.Target{{Ref: mirrorRef}}
+
+	var out bytes.Buffer
+	if err := r.mirrorPull(context.Background(), targets, wantRef, nil, nil, &types.AuthConfig{}, "", &out); err == nil {
+		t.Fatal("expected mirrorPull to return the retag error")
+	}
+	if len(backend.deleted) != 0 {
+		t.Fatalf("did not expect a preexisting mirror tag to be removed, got %v", backend.deleted)
+	}
+}
+
+func TestMirrorPullSurfacesCleanupFailure(t *testing.T) {
+	backend := &fakeBackend{deleteErr: errors.New("disk full"), lookups: map[string]*types.ImageInspect{}}
+	r := &imageRouter{backend: backend}
+
+	wantRef := mustParseNamed(t, "ubuntu:latest")
+	mirrorRef := mustParseNamed(t, "mirror.example.com/library/ubuntu:latest")
+	targets := []rewriter.Target{{Ref: mirrorRef}}
+
+	var out bytes.Buffer
+	if err := r.mirrorPull(context.Background(), targets, wantRef, nil, nil, &types.AuthConfig{}, "", &out); err == nil {
+		t.Fatal("expected mirrorPull to surface the cleanup error")
+	}
+	if !bytes.Contains(out.Bytes(), []byte("errorDetail")) {
+		t.Fatalf("expected the cleanup error to be streamed to the client, got %q", out.String())
+	}
+}
+
+func TestMirrorPullFallsThroughOnNotFound(t *testing.T) {
+	backend := &fakeBackend{
+		pullErrs: []error{errdefs.NotFound(errors.New("not found on first mirror")), nil},
+		lookups:  map[string]*types.ImageInspect{},
+	}
+	r := &imageRouter{backend: backend}
+
+	wantRef := mustParseNamed(t, "ubuntu:latest")
+	first := mustParseNamed(t, "mirror-a.example.com/library/ubuntu:latest")
+	second := mustParseNamed(t, "mirror-b.example.com/library/ubuntu:latest")
+	targets := []rewriter.Target{{Ref: first}, {Ref: second}}
+
+	var out bytes.Buffer
+	if err := r.mirrorPull(context.Background(), targets, wantRef, nil, nil, &types.AuthConfig{}, "", &out); err != nil {
+		t.Fatalf("mirrorPull: %v", err)
+	}
+	if len(backend.pulled) != 2 {
+		t.Fatalf("expected both mirrors to be attempted, got %v", backend.pulled)
+	}
+}
+
+func TestMirrorPullSkipsMirrorFramingWhenNotRewritten(t *testing.T) {
+	backend := &fakeBackend{lookups: map[string]*types.ImageInspect{}}
+	r := &imageRouter{backend: backend}
+
+	wantRef := mustParseNamed(t, "ubuntu:latest")
+	targets := []rewriter.Target{{Ref: wantRef}}
+
+	var out bytes.Buffer
+	if err := r.mirrorPull(context.Background(), targets, wantRef, nil, nil, &types.AuthConfig{}, "", &out); err != nil {
+		t.Fatalf("mirrorPull: %v", err)
+	}
+	if len(backend.tagged) != 0 || len(backend.deleted) != 0 {
+		t.Fatalf("expected no retag/cleanup for an unrewritten pull, got tagged=%v deleted=%v", backend.tagged, backend.deleted)
+	}
+	if bytes.Contains(out.Bytes(), []byte("Pulling from mirror")) {
+		t.Fatalf("expected no mirror status lines for an unrewritten pull, got %q", out.String())
+	}
+}
+
+func TestMirrorPullRollsBackOnDigestMismatch(t *testing.T) {
+	backend := &fakeBackend{lookups: map[string]*types.ImageInspect{}, pulledDigest: testDigestA}
+	r := &imageRouter{backend: backend}
+
+	wantRef := mustParseNamed(t, "ubuntu:latest")
+	mirrorRef := mustParseNamed(t, "mirror.example.com/library/ubuntu:latest")
+	targets := []rewriter.Target{{Ref: mirrorRef}}
+
+	var out bytes.Buffer
+	err := r.mirrorPull(context.Background(), targets, wantRef, nil, nil, &types.AuthConfig{}, digest.Digest(testDigestB), &out)
+	if err == nil || !errdefs.IsInvalidParameter(err) {
+		t.Fatalf("expected InvalidParameter error on digest mismatch, got %v", err)
+	}
+	if len(backend.tagged) != 0 {
+		t.Fatalf("expected no retag to happen before a digest mismatch is caught, got %v", backend.tagged)
+	}
+	if len(backend.deleted) != 1 || backend.deleted[0] != "mirror.example.com/library/ubuntu:latest" {
+		t.Fatalf("expected the pulled mirror tag to be rolled back, got %v", backend.deleted)
+	}
+}
+
+func TestMirrorPullCommitsOnDigestMatch(t *testing.T) {
+	backend := &fakeBackend{lookups: map[string]*types.ImageInspect{}, pulledDigest: testDigestA}
+	r := &imageRouter{backend: backend}
+
+	wantRef := mustParseNamed(t, "ubuntu:latest")
+	mirrorRef := mustParseNamed(t, "mirror.example.com/library/ubuntu:latest")
+	targets := []rewriter.Target{{Ref: mirrorRef}}
+
+	var out bytes.Buffer
+	if err := r.mirrorPull(context.Background(), targets, wantRef, nil, nil, &types.AuthConfig{}, digest.Digest(testDigestA), &out); err != nil {
+		t.Fatalf("mirrorPull: %v", err)
+	}
+	if len(backend.tagged) != 1 {
+		t.Fatalf("expected the pull to be retagged onto the requested name once the digest matched, got %v", backend.tagged)
+	}
+}
+
+func TestMirrorPullDoesNotOverwritePreexistingTagOnDigestMismatchWithoutMirror(t *testing.T) {
+	wantKey := "ubuntu:latest"
+	original := &types.ImageInspect{RepoDigests: []string{"ubuntu@" + testDigestA}}
+	backend := &fakeBackend{
+		lookups:      map[string]*types.ImageInspect{wantKey: original},
+		pulledDigest: testDigestA,
+	}
+	r := &imageRouter{backend: backend}
+
+	wantRef := mustParseNamed(t, "ubuntu:latest")
+	targets := []rewriter.Target{{Ref: wantRef}} // no mirror rule matched
+
+	var out bytes.Buffer
+	err := r.mirrorPull(context.Background(), targets, wantRef, nil, nil, &types.AuthConfig{}, digest.Digest(testDigestB), &out)
+	if err == nil || !errdefs.IsInvalidParameter(err) {
+		t.Fatalf("expected InvalidParameter error on digest mismatch, got %v", err)
+	}
+
+	if backend.lookups[wantKey] != original {
+		t.Fatalf("expected the preexisting tag's metadata to be untouched, got %+v", backend.lookups[wantKey])
+	}
+	if len(backend.tagged) != 0 {
+		t.Fatalf("expected no retag to land on the requested name before the digest was verified, got %v", backend.tagged)
+	}
+	for _, deleted := range backend.deleted {
+		if deleted == wantKey {
+			t.Fatalf("expected the preexisting tag to never be touched, but it was deleted: %v", backend.deleted)
+		}
+	}
+	if len(backend.pulled) != 1 || backend.pulled[0] == wantKey {
+		t.Fatalf("expected the pull to land under a staging name distinct from %s, got %v", wantKey, backend.pulled)
+	}
+}
+
+func TestReportResolvedDigestStreamsDigest(t *testing.T) {
+	wantRef := mustParseNamed(t, "ubuntu:latest")
+	backend := &fakeBackend{
+		lookups: map[string]*types.ImageInspect{
+			"ubuntu:latest": {RepoDigests: []string{"ubuntu@" + testDigestA}},
+		},
+	}
+	r := &imageRouter{backend: backend}
+
+	var out bytes.Buffer
+	if err := r.reportResolvedDigest(wantRef, &out); err != nil {
+		t.Fatalf("reportResolvedDigest: %v", err)
+	}
+	if !bytes.Contains(out.Bytes(), []byte(testDigestA)) {
+		t.Fatalf("expected the resolved digest to be streamed, got %q", out.String())
+	}
+}
+
+func TestRewriteCommitTargetDisabledReturnsUnchanged(t *testing.T) {
+	r := &imageRouter{rewriteCommitRefs: false, resolver: &fakeResolver{}}
+	repo, tag := r.rewriteCommitTarget(context.Background(), "myapp", "v1")
+	if repo != "myapp" || tag != "v1" {
+		t.Fatalf("expected repo/tag unchanged, got %q:%q", repo, tag)
+	}
+}
+
+func TestRewriteCommitTargetUsesResolver(t *testing.T) {
+	mirrorRef := mustParseNamed(t, "mirror.example.com/library/myapp:v1")
+	r := &imageRouter{
+		rewriteCommitRefs: true,
+		resolver:          &fakeResolver{targets: []rewriter.Target{{Ref: mirrorRef}}},
+	}
+	repo, tag := r.rewriteCommitTarget(context.Background(), "myapp", "v1")
+	if repo != "mirror.example.com/library/myapp" || tag != "v1" {
+		t.Fatalf("expected rewritten repo:tag, got %q:%q", repo, tag)
+	}
+}
+
+func TestRewriteCommitTargetNoMatchReturnsUnchanged(t *testing.T) {
+	r := &imageRouter{rewriteCommitRefs: true, resolver: &fakeResolver{}}
+	repo, tag := r.rewriteCommitTarget(context.Background(), "myapp", "v1")
+	if repo != "myapp" || tag != "v1" {
+		t.Fatalf("expected repo/tag unchanged when no rule matches, got %q:%q", repo, tag)
+	}
+}
+
+func TestRewriteCommitTargetEmptyRepoReturnsUnchanged(t *testing.T) {
+	r := &imageRouter{rewriteCommitRefs: true, resolver: &fakeResolver{}}
+	repo, tag := r.rewriteCommitTarget(context.Background(), "", "")
+	if repo != "" || tag != "" {
+		t.Fatalf("expected empty repo/tag unchanged, got %q:%q", repo, tag)
+	}
+}
+
+func TestPostCommit(t *testing.T) {
+	backend := &fakeBackend{lookups: map[string]*types.ImageInspect{}, commitID: "sha256:abc123"}
+	r := &imageRouter{
+		backend:  backend,
+		decoder:  &fakeDecoder{cfg: &container.Config{Image: "base"}},
+		resolver: &fakeResolver{},
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/commit?container=abc&repo=myapp&tag=v1&author=me&comment=hi", nil)
+	w := httptest.NewRecorder()
+
+	if err := r.postCommit(context.Background(), w, req, nil); err != nil {
+		t.Fatalf("postCommit: %v", err)
+	}
+
+	if len(backend.committed) != 1 {
+		t.Fatalf("expected one CommitImage call, got %d", len(backend.committed))
+	}
+	call := backend.committed[0]
+	if call.container != "abc" {
+		t.Fatalf("expected container %q, got %q", "abc", call.container)
+	}
+	if call.cfg.Repo != "myapp" || call.cfg.Tag != "v1" {
+		t.Fatalf("expected repo/tag myapp:v1, got %s:%s", call.cfg.Repo, call.cfg.Tag)
+	}
+	if !call.cfg.Pause {
+		t.Fatal("expected pause to default to true")
+	}
+	if call.cfg.Author != "me" || call.cfg.Comment != "hi" {
+		t.Fatalf("expected author/comment to be threaded through, got %q/%q", call.cfg.Author, call.cfg.Comment)
+	}
+
+	var resp types.IDResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+	if resp.ID != "sha256:abc123" {
+		t.Fatalf("expected response ID %q, got %q", "sha256:abc123", resp.ID)
+	}
+}
+
+func TestPostCommitMissingContainer(t *testing.T) {
+	backend := &fakeBackend{lookups: map[string]*types.ImageInspect{}}
+	r := &imageRouter{backend: backend, decoder: &fakeDecoder{cfg: &container.Config{}}, resolver: &fakeResolver{}}
+
+	req := httptest.NewRequest(http.MethodPost, "/commit", nil)
+	w := httptest.NewRecorder()
+
+	err := r.postCommit(context.Background(), w, req, nil)
+	if err == nil || !errdefs.IsInvalidParameter(err) {
+		t.Fatalf("expected InvalidParameter error, got %v", err)
+	}
+}
+
+func TestPostCommitRewritesRepoThroughResolver(t *testing.T) {
+	mirrorRef := mustParseNamed(t, "mirror.example.com/library/myapp:v1")
+	backend := &fakeBackend{lookups: map[string]*types.ImageInspect{}, commitID: "sha256:abc123"}
+	r := &imageRouter{
+		backend:           backend,
+		decoder:           &fakeDecoder{cfg: &container.Config{}},
+		resolver:          &fakeResolver{targets: []rewriter.Target{{Ref: mirrorRef}}},
+		rewriteCommitRefs: true,
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/commit?container=abc&repo=myapp&tag=v1", nil)
+	w := httptest.NewRecorder()
+
+	if err := r.postCommit(context.Background(), w, req, nil); err != nil {
+		t.Fatalf("postCommit: %v", err)
+	}
+	call := backend.committed[0]
+	if call.cfg.Repo != "mirror.example.com/library/myapp" || call.cfg.Tag != "v1" {
+		t.Fatalf("expected commit to land on the mirror repository, got %s:%s", call.cfg.Repo, call.cfg.Tag)
+	}
+}
@@ -0,0 +1,59 @@
+package image // import "github.com/docker/docker/api/server/router/image"
+
+import (
+	"github.com/docker/docker/api/server/httputils"
+	"github.com/docker/docker/api/server/router"
+	"github.com/docker/docker/registry/rewriter"
+)
+
+// imageRouter is a router to talk with the image controller
+type imageRouter struct {
+	backend           Backend
+	decoder           httputils.ContainerDecoder
+	resolver          rewriter.Resolver
+	rewriteCommitRefs bool
+	routes            []router.Route
+}
+
+// NewRouter initializes a new image router. resolver is consulted by
+// postImagesCreate to rewrite a pull onto one or more mirror registries
+// before falling back to the reference the client requested. When
+// rewriteCommitRefs is set, postCommit routes its repo:tag through the same
+// resolver before committing, so images land under the same namespace
+// conventions whether they were pulled or committed.
+func NewRouter(backend Backend, decoder httputils.ContainerDecoder, resolver rewriter.Resolver, rewriteCommitRefs bool) router.Router {
+	r := &imageRouter{
+		backend:           backend,
+		decoder:           decoder,
+		resolver:          resolver,
+		rewriteCommitRefs: rewriteCommitRefs,
+	}
+	r.initRoutes()
+	return r
+}
+
+// Routes returns the available routes to the image controller
+func (r *imageRouter) Routes() []router.Route {
+	return r.routes
+}
+
+func (r *imageRouter) initRoutes() {
+	r.routes = []router.Route{
+		// GET
+		router.NewGetRoute("/images/json", r.getImagesJSON),
+		router.NewGetRoute("/images/search", r.getImagesSearch),
+		router.NewGetRoute("/images/get", r.getImagesGet),
+		router.NewGetRoute("/images/{name:.*}/get", r.getImagesGet),
+		router.NewGetRoute("/images/{name:.*}/history", r.getImagesHistory),
+		router.NewGetRoute("/images/{name:.*}/json", r.getImagesByName),
+		// POST
+		router.NewPostRoute("/commit", r.postCommit),
+		router.NewPostRoute("/images/load", r.postImagesLoad),
+		router.NewPostRoute("/images/create", r.postImagesCreate),
+		router.NewPostRoute("/images/{name:.*}/push", r.postImagesPush),
+		router.NewPostRoute("/images/{name:.*}/tag", r.postImagesTag),
+		router.NewPostRoute("/images/prune", r.postImagesPrune),
+		// DELETE
+		router.NewDeleteRoute("/images/{name:.*}", r.deleteImages),
+	}
+}
@@ -0,0 +1,58 @@
+package rewriter // import "github.com/docker/docker/registry/rewriter"
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/docker/distribution/reference"
+)
+
+// CachingResolver wraps another Resolver and caches its decisions in memory
+// for ttl, keyed by the requested reference, so that a config file or
+// external helper isn't contacted on every pull.
+type CachingResolver struct {
+	next Resolver
+	ttl  time.Duration
+
+	mu    sync.Mutex
+	cache map[string]cacheEntry
+}
+
+type cacheEntry struct {
+	targets []Target
+	expires time.Time
+}
+
+// NewCachingResolver wraps next so that repeated Resolve calls for the same
+// reference within ttl are served from memory instead of calling next again.
+func NewCachingResolver(next Resolver, ttl time.Duration) *CachingResolver {
+	return &CachingResolver{
+		next:  next,
+		ttl:   ttl,
+		cache: make(map[string]cacheEntry),
+	}
+}
+
+// Resolve implements Resolver.
+func (c *CachingResolver) Resolve(ctx context.Context, ref reference.Named) ([]Target, error) {
+	key := ref.String()
+
+	c.mu.Lock()
+	entry, ok := c.cache[key]
+	c.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.targets, nil
+	}
+
+	targets, err := c.next.Resolve(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.cache[key] = cacheEntry{targets: targets, expires: time.Now().Add(c.ttl)}
+	c.mu.Unlock()
+
+	return targets, nil
+}
@@ -0,0 +1,70 @@
+package rewriter // import "github.com/docker/docker/registry/rewriter"
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/reference"
+)
+
+// countingResolver records how many times Resolve was called and always
+// returns the same fixed targets.
+type countingResolver struct {
+	targets []Target
+	calls   int
+}
+
+func (c *countingResolver) Resolve(ctx context.Context, ref reference.Named) ([]Target, error) {
+	c.calls++
+	return c.targets, nil
+}
+
+func TestCachingResolverServesFromCacheWithinTTL(t *testing.T) {
+	next := &countingResolver{targets: []Target{{Ref: mustParseNamed(t, "mirror.example.com/library/ubuntu:latest")}}}
+	c := NewCachingResolver(next, time.Minute)
+
+	ref := mustParseNamed(t, "library/ubuntu:latest")
+	for i := 0; i < 3; i++ {
+		if _, err := c.Resolve(context.Background(), ref); err != nil {
+			t.Fatalf("Resolve: %v", err)
+		}
+	}
+	if next.calls != 1 {
+		t.Fatalf("expected the underlying resolver to be called once, got %d", next.calls)
+	}
+}
+
+func TestCachingResolverRefreshesAfterTTLExpires(t *testing.T) {
+	next := &countingResolver{targets: []Target{{Ref: mustParseNamed(t, "mirror.example.com/library/ubuntu:latest")}}}
+	c := NewCachingResolver(next, time.Millisecond)
+
+	ref := mustParseNamed(t, "library/ubuntu:latest")
+	if _, err := c.Resolve(context.Background(), ref); err != nil {
+		t.Fatalf("Resolve: %v", err)
+	}
+
+	time.Sleep(5 * time.Millisecond)
+
+	if _, err := c.Resolve(context.Background(), ref); err != nil {
+		t.Fatalf("Resolve: %v", err)
+	}
+	if next.calls != 2 {
+		t.Fatalf("expected the underlying resolver to be called again once the TTL expired, got %d", next.calls)
+	}
+}
+
+func TestCachingResolverCachesPerReference(t *testing.T) {
+	next := &countingResolver{targets: []Target{{Ref: mustParseNamed(t, "mirror.example.com/library/ubuntu:latest")}}}
+	c := NewCachingResolver(next, time.Minute)
+
+	if _, err := c.Resolve(context.Background(), mustParseNamed(t, "library/ubuntu:latest")); err != nil {
+		t.Fatalf("Resolve: %v", err)
+	}
+	if _, err := c.Resolve(context.Background(), mustParseNamed(t, "library/alpine:latest")); err != nil {
+		t.Fatalf("Resolve: %v", err)
+	}
+	if next.calls != 2 {
+		t.Fatalf("expected distinct references not to share a cache entry, got %d calls", next.calls)
+	}
+}
@@ -0,0 +1,53 @@
+// Package rewriter implements a pluggable mirror-rewriter subsystem. It maps
+// an image reference requested by a pull into an ordered list of candidate
+// mirror registries, so that api/server/router/image can retry a pull
+// against the next candidate when the current one is unreachable or lacks
+// the image.
+package rewriter
+
+import (
+	"context"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types"
+)
+
+// DefaultRegistry is the registry domain used when a Resolver has no better
+// answer, matching the default applied by reference.ParseNormalizedNamed.
+const DefaultRegistry = "docker.io"
+
+// Target is a single mirror candidate produced by a Resolver: a fully
+// qualified reference to pull instead of the one the client asked for.
+type Target struct {
+	// Ref is the reference to pull from the mirror. It carries the same tag
+	// or digest as the reference the client requested.
+	Ref reference.Named
+	// Auth holds the credentials to use against this specific mirror, or nil
+	// to fall back to the credentials supplied by the client.
+	Auth *types.AuthConfig
+}
+
+// Resolver resolves a requested image reference into an ordered list of
+// mirror Targets to try. Callers attempt each Target in turn, falling
+// through to the next on a not-found or network error, and use the
+// client-requested reference directly when the list is empty.
+type Resolver interface {
+	Resolve(ctx context.Context, ref reference.Named) ([]Target, error)
+}
+
+// withSameTagOrDigest copies the tag or digest of src onto named, so a
+// rewritten mirror reference still points at the version the client asked
+// for.
+func withSameTagOrDigest(named reference.Named, src reference.Named) reference.Named {
+	if canonical, ok := src.(reference.Canonical); ok {
+		if r, err := reference.WithDigest(named, canonical.Digest()); err == nil {
+			return r
+		}
+	}
+	if tagged, ok := src.(reference.Tagged); ok {
+		if r, err := reference.WithTag(named, tagged.Tag()); err == nil {
+			return r
+		}
+	}
+	return named
+}
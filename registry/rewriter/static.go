@@ -0,0 +1,133 @@
+package rewriter // import "github.com/docker/docker/registry/rewriter"
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types"
+	"github.com/pkg/errors"
+)
+
+// MirrorRule describes how references matching Source should be rewritten
+// onto Target. Rules are evaluated in order, and every matching rule
+// contributes one candidate to the fallback chain, so the first rules in
+// Config.Rules are tried first.
+type MirrorRule struct {
+	// Source is a glob matched against the normalized "domain/repository"
+	// of the requested reference, e.g. "docker.io/library/*" or
+	// "docker.io/*". Each "/"-separated segment is matched as by
+	// filepath.Match, except that a trailing "*" segment matches the whole
+	// remainder of the path, however many segments it has.
+	Source string `json:"source"`
+	// Target is the registry domain the matched reference is rewritten
+	// onto, e.g. "mirror.example.com".
+	Target string `json:"target"`
+	// PathPrefix, when set, is prepended to the repository path once the
+	// registry domain has been rewritten.
+	PathPrefix string `json:"pathPrefix,omitempty"`
+	// Auth holds the credentials used to authenticate against Target.
+	Auth *types.AuthConfig `json:"auth,omitempty"`
+}
+
+// Config is the daemon-level configuration for the mirror rewriter,
+// typically loaded from the file referenced by the daemon's
+// --registry-mirror-config flag.
+type Config struct {
+	// Rules is the ordered list of mirror rules evaluated for every pull.
+	Rules []MirrorRule `json:"rules"`
+}
+
+// LoadConfig reads and parses a mirror-rewriter Config from a JSON file at
+// path.
+func LoadConfig(path string) (*Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "loading mirror-rewriter config")
+	}
+	defer f.Close()
+
+	var cfg Config
+	if err := json.NewDecoder(f).Decode(&cfg); err != nil {
+		return nil, errors.Wrap(err, "parsing mirror-rewriter config")
+	}
+	return &cfg, nil
+}
+
+// StaticResolver resolves references against a fixed, in-memory Config. It
+// is the Resolver implementation used when mirrors are declared directly in
+// the daemon configuration rather than discovered through an external
+// helper.
+type StaticResolver struct {
+	cfg *Config
+}
+
+// NewStaticResolver returns a Resolver backed by cfg.
+func NewStaticResolver(cfg *Config) *StaticResolver {
+	return &StaticResolver{cfg: cfg}
+}
+
+// Resolve implements Resolver.
+func (s *StaticResolver) Resolve(ctx context.Context, ref reference.Named) ([]Target, error) {
+	domainPath := reference.Domain(ref) + "/" + reference.Path(ref)
+
+	var targets []Target
+	for _, rule := range s.cfg.Rules {
+		matched, err := matchSource(rule.Source, domainPath)
+		if err != nil || !matched {
+			continue
+		}
+
+		path := reference.Path(ref)
+		if rule.PathPrefix != "" {
+			path = strings.TrimSuffix(rule.PathPrefix, "/") + "/" + path
+		}
+
+		named, err := reference.WithName(rule.Target + "/" + path)
+		if err != nil {
+			continue
+		}
+
+		targets = append(targets, Target{Ref: withSameTagOrDigest(named, ref), Auth: rule.Auth})
+	}
+	return targets, nil
+}
+
+// matchSource reports whether domainPath (the normalized "domain/repository"
+// of a reference) matches a MirrorRule.Source pattern. filepath.Match alone
+// isn't enough here: its "*" never crosses a "/", so the catch-all form
+// documented on MirrorRule.Source ("docker.io/*", to match every repository
+// under a registry) would never match a multi-segment repository like
+// "docker.io/library/ubuntu". matchSource special-cases a trailing "*"
+// segment to match the remainder of the path, however many segments it has,
+// while every other segment is still matched with filepath.Match. This
+// applies to any trailing "*", so "docker.io/library/*" matches
+// "docker.io/library/ubuntu" and also deeper paths such as
+// "docker.io/library/a/b".
+func matchSource(source, domainPath string) (bool, error) {
+	patternSegs := strings.Split(source, "/")
+	inputSegs := strings.Split(domainPath, "/")
+
+	fixed := len(patternSegs)
+	wildcardTail := patternSegs[fixed-1] == "*"
+	if wildcardTail {
+		fixed--
+	} else if len(patternSegs) != len(inputSegs) {
+		return false, nil
+	}
+
+	if len(inputSegs) < fixed {
+		return false, nil
+	}
+
+	for i := 0; i < fixed; i++ {
+		matched, err := filepath.Match(patternSegs[i], inputSegs[i])
+		if err != nil || !matched {
+			return false, err
+		}
+	}
+	return true, nil
+}
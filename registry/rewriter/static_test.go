@@ -0,0 +1,127 @@
+package rewriter // import "github.com/docker/docker/registry/rewriter"
+
+import (
+	"context"
+	"testing"
+
+	"github.com/docker/distribution/reference"
+)
+
+func mustParseNamed(t *testing.T, s string) reference.Named {
+	t.Helper()
+	ref, err := reference.ParseNormalizedNamed(s)
+	if err != nil {
+		t.Fatalf("parsing %q: %v", s, err)
+	}
+	return ref
+}
+
+func TestMatchSourceSingleSegmentWildcard(t *testing.T) {
+	matched, err := matchSource("docker.io/library/*", "docker.io/library/ubuntu")
+	if err != nil {
+		t.Fatalf("matchSource: %v", err)
+	}
+	if !matched {
+		t.Fatal("expected a single-segment wildcard to match a single-segment repository")
+	}
+}
+
+func TestMatchSourceMultiSegmentWildcard(t *testing.T) {
+	// A trailing "*" on the registry domain is documented as matching every
+	// repository under that registry, including multi-segment ones -
+	// filepath.Match alone would reject this because its "*" never crosses
+	// a "/".
+	matched, err := matchSource("docker.io/*", "docker.io/library/ubuntu")
+	if err != nil {
+		t.Fatalf("matchSource: %v", err)
+	}
+	if !matched {
+		t.Fatal("expected docker.io/* to match a multi-segment repository under docker.io")
+	}
+}
+
+func TestMatchSourceNoMatchDifferentRegistry(t *testing.T) {
+	matched, err := matchSource("docker.io/*", "quay.io/library/ubuntu")
+	if err != nil {
+		t.Fatalf("matchSource: %v", err)
+	}
+	if matched {
+		t.Fatal("expected docker.io/* not to match a different registry")
+	}
+}
+
+func TestMatchSourceExactSegmentCountRequiredWithoutWildcard(t *testing.T) {
+	matched, err := matchSource("docker.io/library/ubuntu", "docker.io/library/ubuntu/extra")
+	if err != nil {
+		t.Fatalf("matchSource: %v", err)
+	}
+	if matched {
+		t.Fatal("expected a non-wildcard source to require an exact segment count")
+	}
+}
+
+func TestStaticResolverRewritesRegistryDomain(t *testing.T) {
+	cfg := &Config{Rules: []MirrorRule{{Source: "docker.io/*", Target: "mirror.example.com"}}}
+	r := NewStaticResolver(cfg)
+
+	targets, err := r.Resolve(context.Background(), mustParseNamed(t, "library/ubuntu:latest"))
+	if err != nil {
+		t.Fatalf("Resolve: %v", err)
+	}
+	if len(targets) != 1 {
+		t.Fatalf("expected one target, got %d", len(targets))
+	}
+	if got := targets[0].Ref.String(); got != "mirror.example.com/library/ubuntu:latest" {
+		t.Fatalf("expected mirror.example.com/library/ubuntu:latest, got %s", got)
+	}
+}
+
+func TestStaticResolverAppliesPathPrefix(t *testing.T) {
+	cfg := &Config{Rules: []MirrorRule{{
+		Source:     "docker.io/*",
+		Target:     "mirror.example.com",
+		PathPrefix: "upstream/",
+	}}}
+	r := NewStaticResolver(cfg)
+
+	targets, err := r.Resolve(context.Background(), mustParseNamed(t, "library/ubuntu:latest"))
+	if err != nil {
+		t.Fatalf("Resolve: %v", err)
+	}
+	if len(targets) != 1 {
+		t.Fatalf("expected one target, got %d", len(targets))
+	}
+	if got := targets[0].Ref.String(); got != "mirror.example.com/upstream/library/ubuntu:latest" {
+		t.Fatalf("expected the path prefix to be prepended, got %s", got)
+	}
+}
+
+func TestStaticResolverNoMatchReturnsNoTargets(t *testing.T) {
+	cfg := &Config{Rules: []MirrorRule{{Source: "quay.io/*", Target: "mirror.example.com"}}}
+	r := NewStaticResolver(cfg)
+
+	targets, err := r.Resolve(context.Background(), mustParseNamed(t, "library/ubuntu:latest"))
+	if err != nil {
+		t.Fatalf("Resolve: %v", err)
+	}
+	if len(targets) != 0 {
+		t.Fatalf("expected no targets when no rule matches, got %v", targets)
+	}
+}
+
+func TestStaticResolverPreservesDigest(t *testing.T) {
+	cfg := &Config{Rules: []MirrorRule{{Source: "docker.io/*", Target: "mirror.example.com"}}}
+	r := NewStaticResolver(cfg)
+
+	digest := "sha256:aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	targets, err := r.Resolve(context.Background(), mustParseNamed(t, "library/ubuntu@"+digest))
+	if err != nil {
+		t.Fatalf("Resolve: %v", err)
+	}
+	if len(targets) != 1 {
+		t.Fatalf("expected one target, got %d", len(targets))
+	}
+	if got := targets[0].Ref.String(); got != "mirror.example.com/library/ubuntu@"+digest {
+		t.Fatalf("expected the digest to be preserved, got %s", got)
+	}
+}
@@ -0,0 +1,71 @@
+package rewriter // import "github.com/docker/docker/registry/rewriter"
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+	"github.com/pkg/errors"
+)
+
+// UnixSocketResolver is the legacy Resolver implementation: it asks an
+// external helper process, reachable over a Unix domain socket, which
+// registry domain a reference should be pulled through. It is kept for
+// deployments that already run that helper; new deployments should prefer a
+// StaticResolver driven by Config.
+type UnixSocketResolver struct {
+	addr *net.UnixAddr
+}
+
+// NewUnixSocketResolver returns a Resolver that queries the helper listening
+// on the Unix socket at path.
+func NewUnixSocketResolver(path string) *UnixSocketResolver {
+	return &UnixSocketResolver{addr: &net.UnixAddr{Name: path, Net: "unix"}}
+}
+
+// Resolve implements Resolver.
+func (u *UnixSocketResolver) Resolve(ctx context.Context, ref reference.Named) ([]Target, error) {
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(_ context.Context, _, _ string) (net.Conn, error) {
+				return net.DialUnix("unix", nil, u.addr)
+			},
+		},
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://dockerd/"+reference.Path(ref), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("resolve registry url: unexpected status code %d", resp.StatusCode)
+	}
+
+	buf := make([]byte, 256)
+	n, err := resp.Body.Read(buf)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	domain := strings.TrimSpace(string(buf[:n]))
+	if domain == "" {
+		domain = DefaultRegistry
+	}
+
+	named, err := reference.WithName(domain + "/" + reference.Path(ref))
+	if err != nil {
+		return nil, err
+	}
+
+	return []Target{{Ref: withSameTagOrDigest(named, ref)}}, nil
+}
@@ -0,0 +1,70 @@
+package rewriter // import "github.com/docker/docker/registry/rewriter"
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+func serveUnixSocket(t *testing.T, body string, status int) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "resolver.sock")
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("listening on unix socket: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(body))
+	})}
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+
+	return path
+}
+
+func TestUnixSocketResolverUsesHelperResponse(t *testing.T) {
+	path := serveUnixSocket(t, "mirror.example.com", http.StatusOK)
+	r := NewUnixSocketResolver(path)
+
+	targets, err := r.Resolve(context.Background(), mustParseNamed(t, "library/ubuntu:latest"))
+	if err != nil {
+		t.Fatalf("Resolve: %v", err)
+	}
+	if len(targets) != 1 {
+		t.Fatalf("expected one target, got %d", len(targets))
+	}
+	if got := targets[0].Ref.String(); got != "mirror.example.com/library/ubuntu:latest" {
+		t.Fatalf("expected mirror.example.com/library/ubuntu:latest, got %s", got)
+	}
+}
+
+func TestUnixSocketResolverFallsBackToDefaultRegistry(t *testing.T) {
+	path := serveUnixSocket(t, "", http.StatusOK)
+	r := NewUnixSocketResolver(path)
+
+	targets, err := r.Resolve(context.Background(), mustParseNamed(t, "library/ubuntu:latest"))
+	if err != nil {
+		t.Fatalf("Resolve: %v", err)
+	}
+	if len(targets) != 1 {
+		t.Fatalf("expected one target, got %d", len(targets))
+	}
+	if got := targets[0].Ref.String(); got != DefaultRegistry+"/library/ubuntu:latest" {
+		t.Fatalf("expected the default registry to be used, got %s", got)
+	}
+}
+
+func TestUnixSocketResolverSurfacesHelperError(t *testing.T) {
+	path := serveUnixSocket(t, "boom", http.StatusInternalServerError)
+	r := NewUnixSocketResolver(path)
+
+	if _, err := r.Resolve(context.Background(), mustParseNamed(t, "library/ubuntu:latest")); err == nil {
+		t.Fatal("expected an error when the helper reports a non-200 status")
+	}
+}